@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
@@ -19,12 +22,24 @@ func main() {
 		Name:  "debug, d",
 		Usage: "enable debugging",
 	}
+	var flagStateDB = cli.StringFlag{
+		Name:  "state-db",
+		Value: "/var/lib/docker-ovs-plugin/state.db",
+		Usage: "path to the boltdb file used to persist network state across restarts",
+	}
+	var flagPortRange = cli.StringFlag{
+		Name:  "port-range",
+		Value: fmt.Sprintf("%d-%d", ovs.DefaultHostPortRangeStart, ovs.DefaultHostPortRangeEnd),
+		Usage: "host port range (start-end) available for auto-allocated published ports",
+	}
 	app := cli.NewApp()
 	app.Name = "don"
 	app.Usage = "Docker Open vSwitch Networking"
 	app.Version = version
 	app.Flags = []cli.Flag{
 		flagDebug,
+		flagStateDB,
+		flagPortRange,
 	}
 	app.Action = Run
 	app.Run(os.Args)
@@ -36,11 +51,33 @@ func Run(ctx *cli.Context) {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	portRangeStart, portRangeEnd, err := parsePortRange(ctx.String("port-range"))
+	if err != nil {
+		panic(err)
+	}
+
 	name := "ovs"
-	d, err := ovs.NewDriver(name)
+	d, err := ovs.NewDriver(name, ctx.String("state-db"), portRangeStart, portRangeEnd)
 	if err != nil {
 		panic(err)
 	}
 	h := dknet.NewHandler(d)
 	h.ServeUnix(name, 0)
 }
+
+// parsePortRange parses a "start-end" host port range flag value.
+func parsePortRange(s string) (start, end int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q, expected format start-end", s)
+	}
+	start, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %s", s, err)
+	}
+	end, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %s", s, err)
+	}
+	return start, end, nil
+}
@@ -2,8 +2,13 @@ package ovs
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os/exec"
+	"regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -25,6 +30,26 @@ const (
 	modeOption          = "net.gopher.ovs.bridge.mode"
 	bridgeNameOption    = "net.gopher.ovs.bridge.name"
 	bindInterfaceOption = "net.gopher.ovs.bridge.bind_interface"
+	controllerOption    = "net.gopher.ovs.bridge.controller"
+	dpidOption          = "net.gopher.ovs.bridge.dpid"
+	addPortsOption      = "net.gopher.ovs.bridge.add_ports"
+	ipMasqueradeOption  = "net.gopher.ovs.bridge.enable_ip_masquerade"
+	iccOption           = "net.gopher.ovs.bridge.enable_icc"
+	enableIPv6Option    = "net.gopher.ovs.bridge.enable_ipv6"
+	vlanOption          = "net.gopher.ovs.bridge.vlan"
+
+	minVlanTag = 1
+	maxVlanTag = 4094
+
+	familyV4 = "v4"
+	familyV6 = "v6"
+
+	gatewayAuxAddressV4 = "DefaultGatewayIPv4"
+	gatewayAuxAddressV6 = "DefaultGatewayIPv6"
+
+	// linkOption carries the comma-separated list of peer endpoint IDs a
+	// container was started with --link.
+	linkOption = "com.docker.network.endpoint.link"
 
 	modeNAT  = "nat"
 	modeFlat = "flat"
@@ -45,21 +70,72 @@ type Driver struct {
 	dknet.Driver
 	dockerer
 	ovsdber
-	networks map[string]*NetworkState
+	networks    map[string]*NetworkState
+	datastore   *stateStore
+	endpointIPs map[string]net.IP
+	portmapper  *portmapper
+	bridgeRefs  map[string]int
+	bridgeICC   map[string]bool // EnableICC actually in effect for a shared bridge, keyed by bridge name
 	OvsdbNotifier
 }
 
 // NetworkState is filled in at network creation time
 // it contains state that we wish to keep for each network
 type NetworkState struct {
-	BridgeName        string
-	MTU               int
-	Mode              string
-	Gateway           string
-	GatewayMask       string
-	FlatBindInterface string
+	BridgeName         string
+	MTU                int
+	Mode               string
+	IPAM               []IPAMEntry
+	FlatBindInterface  string
+	Controllers        []string
+	Dpid               string
+	AddPorts           []AddPort
+	EnableIPMasquerade bool
+	EnableICC          bool
+	EnableIPv6         bool
+	VlanTag            int
+}
+
+// IPAMEntry is one gateway address libnetwork's IPAM handed us for a
+// network, either IPv4 or IPv6. A network may have several: one per
+// family in the dual-stack case, or more if multiple subnets are attached.
+type IPAMEntry struct {
+	IP      string
+	Mask    string
+	Gateway string
+	Family  string
+}
+
+// GatewayIPv4 returns the first IPv4 gateway recorded for the network, or
+// the empty string if none was assigned.
+func (ns *NetworkState) GatewayIPv4() string {
+	return ns.gatewayForFamily(familyV4)
+}
+
+// GatewayIPv6 returns the first IPv6 gateway recorded for the network, or
+// the empty string if none was assigned.
+func (ns *NetworkState) GatewayIPv6() string {
+	return ns.gatewayForFamily(familyV6)
+}
+
+func (ns *NetworkState) gatewayForFamily(family string) string {
+	for _, entry := range ns.IPAM {
+		if entry.Family == family && entry.Gateway != "" {
+			return entry.Gateway
+		}
+	}
+	return ""
+}
+
+// AddPort describes a physical interface to be attached to a bridge at
+// creation time, with an optional pinned OpenFlow port number.
+type AddPort struct {
+	Name   string
+	OFPort int
 }
 
+var dpidPattern = regexp.MustCompile(`^[0-9a-fA-F]{16}$`)
+
 func (d *Driver) findNetworkState(id string) (*NetworkState, error) {
 	ns, found := d.networks[id]
 	if found {
@@ -70,7 +146,6 @@ func (d *Driver) findNetworkState(id string) (*NetworkState, error) {
 		return nil, fmt.Errorf("Docker client disabled; unable to get network state")
 	}
 
-
 	network, err := d.dockerer.client.InspectNetwork(id)
 	if err != nil {
 		return nil, err
@@ -82,26 +157,102 @@ func (d *Driver) findNetworkState(id string) (*NetworkState, error) {
 		return nil, fmt.Errorf("Not our network")
 	}
 
-	gateway := ""
-
+	var ipam []IPAMEntry
 	for _, value := range network.IPAM.Config {
-		ip := net.ParseIP(value.Gateway)
-		if ip.To4() != nil {
-			gateway = value.Gateway
-			break
+		entry, err := ipamEntryFromCIDR(value.Gateway)
+		if err != nil {
+			log.Warnf("findNetworkState: skipping unparsable gateway %q for network %s: %s", value.Gateway, id, err)
+			continue
 		}
+		ipam = append(ipam, entry)
 	}
 
-	return d.setupNetworkState(id, network.Options, gateway)
+	return d.setupNetworkState(id, network.Options, ipam)
 }
 
 func (d *Driver) CreateNetwork(r *dknet.CreateNetworkRequest) error {
 	log.Debugf("Create network request: %+v", r)
-	// FIXME
-	_, err := d.setupNetworkState(r.NetworkID, stringOptions(r), r.IPv4Data[0].Gateway)
+	options := stringOptions(r)
+
+	ipam, err := ipamEntriesFromRequest(r, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.setupNetworkState(r.NetworkID, options, ipam)
 	return err
 }
 
+// ipamEntriesFromRequest builds the IPAMEntry list for a new network out
+// of the v4 (and, if opted in, v6) pools libnetwork's IPAM handed us,
+// honouring any DefaultGatewayIPv4/DefaultGatewayIPv6 aux address that
+// overrides the pool's own gateway.
+func ipamEntriesFromRequest(r *dknet.CreateNetworkRequest, options map[string]string) ([]IPAMEntry, error) {
+	var entries []IPAMEntry
+
+	for _, data := range r.IPv4Data {
+		entry, err := ipamEntryFromData(data, familyV4, gatewayAuxAddressV4)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+
+	if options[enableIPv6Option] == "true" {
+		for _, data := range r.IPv6Data {
+			entry, err := ipamEntryFromData(data, familyV6, gatewayAuxAddressV6)
+			if err != nil {
+				return nil, err
+			}
+			if entry != nil {
+				entries = append(entries, *entry)
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func ipamEntryFromData(data *dknet.IPAMData, family, auxAddressKey string) (*IPAMEntry, error) {
+	if data == nil {
+		return nil, nil
+	}
+	gateway := data.Gateway
+	if aux, ok := data.AuxAddresses[auxAddressKey]; ok && aux != "" {
+		gateway = aux
+	}
+	if gateway == "" {
+		return nil, nil
+	}
+	entry, err := ipamEntryFromCIDR(gateway)
+	if err != nil {
+		return nil, err
+	}
+	entry.Family = family
+	return &entry, nil
+}
+
+// ipamEntryFromCIDR splits a "<ip>/<mask>" gateway string as handed to us
+// by libnetwork into its IP and mask, classifying the address family by
+// inspecting the IP itself.
+func ipamEntryFromCIDR(gateway string) (IPAMEntry, error) {
+	parts := strings.SplitN(gateway, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return IPAMEntry{}, fmt.Errorf("cannot split gateway address %q into ip/mask", gateway)
+	}
+	ip := net.ParseIP(parts[0])
+	if ip == nil {
+		return IPAMEntry{}, fmt.Errorf("%q is not a valid IP address", parts[0])
+	}
+	family := familyV4
+	if ip.To4() == nil {
+		family = familyV6
+	}
+	return IPAMEntry{IP: parts[0], Mask: parts[1], Gateway: parts[0], Family: family}, nil
+}
+
 // By bboreham from https://github.com/weaveworks/weave/
 //
 // Deal with excessively-generic way the options get decoded from JSON
@@ -122,7 +273,7 @@ func stringOptions(create *dknet.CreateNetworkRequest) map[string]string {
 	return nil
 }
 
-func (d *Driver) setupNetworkState(id string, options map[string]string, gateway string) (*NetworkState, error) {
+func (d *Driver) setupNetworkState(id string, options map[string]string, ipam []IPAMEntry) (*NetworkState, error) {
 	bridgeName, err := getBridgeName(id, options)
 	if err != nil {
 		return nil, err
@@ -138,59 +289,257 @@ func (d *Driver) setupNetworkState(id string, options map[string]string, gateway
 		return nil, err
 	}
 
-	// FIXME
-	mask := "24"
+	bindInterface, err := getBindInterface(options)
+	if err != nil {
+		return nil, err
+	}
+
+	controllers, err := getControllers(options)
+	if err != nil {
+		return nil, err
+	}
 
-/*
-	gateway, mask, err := getGatewayIP(options)
+	dpid, err := getDpid(options)
 	if err != nil {
 		return nil, err
 	}
-*/
 
-	bindInterface, err := getBindInterface(options)
+	addPorts, err := getAddPorts(options)
 	if err != nil {
 		return nil, err
 	}
 
+	vlanTag, err := getVlanTag(options)
+	if err != nil {
+		return nil, err
+	}
+
+	enableIPMasquerade := options[ipMasqueradeOption] == "true"
+	enableICC := options[iccOption] != "false"
+	enableIPv6 := options[enableIPv6Option] == "true"
+
 	ns := &NetworkState{
-		BridgeName:        bridgeName,
-		MTU:               mtu,
-		Mode:              mode,
-		Gateway:           gateway,
-		GatewayMask:       mask,
-		FlatBindInterface: bindInterface,
+		BridgeName:         bridgeName,
+		MTU:                mtu,
+		Mode:               mode,
+		IPAM:               ipam,
+		FlatBindInterface:  bindInterface,
+		Controllers:        controllers,
+		Dpid:               dpid,
+		AddPorts:           addPorts,
+		EnableIPMasquerade: enableIPMasquerade,
+		EnableICC:          enableICC,
+		EnableIPv6:         enableIPv6,
+		VlanTag:            vlanTag,
 	}
 	d.networks[id] = ns
 
-	log.Debugf("Initializing bridge for network %s", id)
-	if err := d.initBridge(id); err != nil {
+	createdBridge := d.bridgeRefs[bridgeName] == 0
+
+	if d.bridgeRefs[bridgeName] > 0 {
+		log.Debugf("Bridge [ %s ] is already managed by another network, reference-counting instead of re-initializing", bridgeName)
+		if existingICC, ok := d.bridgeICC[bridgeName]; ok && existingICC != enableICC {
+			log.Warnf("network %s requested enable_icc=%t on bridge %s, but network sharing that bridge already set it to %t; keeping the existing policy", id, enableICC, bridgeName, existingICC)
+		}
+	} else {
+		log.Debugf("Initializing bridge for network %s", id)
+		if err := d.initBridge(id); err != nil {
+			delete(d.networks, id)
+			return nil, err
+		}
+
+		if err := applyBridgeOptions(ns); err != nil {
+			if delErr := d.deleteBridge(ns); delErr != nil {
+				log.Errorf("Unable to roll back bridge %s after failed setup: %s", bridgeName, delErr)
+			}
+			delete(d.networks, id)
+			return nil, err
+		}
+
+		if !enableICC {
+			if err := installICCDenyFlow(bridgeName); err != nil {
+				log.Errorf("Unable to install ICC deny flow on bridge %s: %s", bridgeName, err)
+			}
+		}
+		d.bridgeICC[bridgeName] = enableICC
+	}
+
+	// Gateway addresses and the masquerade rule are per-network, not
+	// per-bridge, so they're applied for every network on a bridge, not
+	// just the one that first created it.
+	if err := d.configureBridgeAddresses(ns); err != nil {
+		if createdBridge {
+			if delErr := d.deleteBridge(ns); delErr != nil {
+				log.Errorf("Unable to roll back bridge %s after failed setup: %s", bridgeName, delErr)
+			}
+		}
 		delete(d.networks, id)
 		return nil, err
 	}
+
+	if enableIPMasquerade {
+		if subnet, ok := subnetForMasquerade(ns); ok {
+			if err := installIPMasquerade(bridgeName, subnet); err != nil {
+				log.Errorf("Unable to install IP masquerade rule for bridge %s: %s", bridgeName, err)
+			}
+		} else {
+			log.Warnf("enable_ip_masquerade requested for bridge %s but no IPv4 subnet is known", bridgeName)
+		}
+	}
+
+	d.bridgeRefs[bridgeName]++
+
+	if d.datastore != nil {
+		rec := &networkRecord{State: ns, Options: options}
+		if err := d.datastore.put(id, rec); err != nil {
+			log.Errorf("Unable to persist state for network %s: %s", id, err)
+		}
+	}
 	return ns, nil
 }
 
+// configureBridgeAddresses assigns every gateway address we hold for the
+// network to the bridge's own internal port, and, if IPv6 was opted
+// into, makes sure the kernel hasn't got it disabled on that interface.
+func (d *Driver) configureBridgeAddresses(ns *NetworkState) error {
+	link, err := netlink.LinkByName(ns.BridgeName)
+	if err != nil {
+		return fmt.Errorf("could not find bridge %s to assign addresses: %s", ns.BridgeName, err)
+	}
+
+	for _, entry := range ns.IPAM {
+		if entry.Family == familyV6 && !ns.EnableIPv6 {
+			continue
+		}
+		addr, err := netlink.ParseAddr(fmt.Sprintf("%s/%s", entry.IP, entry.Mask))
+		if err != nil {
+			return fmt.Errorf("could not parse gateway address %s/%s: %s", entry.IP, entry.Mask, err)
+		}
+		if err := netlink.AddrAdd(link, addr); err != nil && err != syscall.EEXIST {
+			return fmt.Errorf("could not assign address %s to bridge %s: %s", addr, ns.BridgeName, err)
+		}
+	}
+
+	if ns.EnableIPv6 {
+		if err := enableBridgeIPv6(ns.BridgeName); err != nil {
+			log.Warnf("could not enable IPv6 on bridge %s: %s", ns.BridgeName, err)
+		}
+	}
+	return nil
+}
+
+// enableBridgeIPv6 clears net.ipv6.conf.<bridge>.disable_ipv6, which
+// Linux otherwise tends to set on bridges that came up without any IPv6
+// address already configured.
+func enableBridgeIPv6(bridgeName string) error {
+	path := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/disable_ipv6", bridgeName)
+	return ioutil.WriteFile(path, []byte("0"), 0644)
+}
+
+// applyBridgeOptions applies the OVSDB-level options carried on the
+// network state that initBridge itself doesn't know about: attaching the
+// bridge to its OpenFlow controller(s), pinning its datapath ID, and
+// attaching any pre-added physical ports.
+func applyBridgeOptions(ns *NetworkState) error {
+	if len(ns.Controllers) > 0 {
+		if err := setControllers(ns.BridgeName, ns.Controllers); err != nil {
+			return fmt.Errorf("could not set controller(s) on bridge %s: %s", ns.BridgeName, err)
+		}
+	}
+
+	if ns.Dpid != "" {
+		if err := vsctl("set", "Bridge", ns.BridgeName, fmt.Sprintf("other_config:datapath-id=%s", ns.Dpid)); err != nil {
+			return fmt.Errorf("could not set datapath-id on bridge %s: %s", ns.BridgeName, err)
+		}
+	}
+
+	for _, port := range ns.AddPorts {
+		if err := addPhysicalPort(ns.BridgeName, port); err != nil {
+			return fmt.Errorf("could not attach port %s to bridge %s: %s", port.Name, ns.BridgeName, err)
+		}
+	}
+
+	return nil
+}
+
+// setControllers points a bridge at one or more OpenFlow controller
+// targets. set-controller replaces the whole list, which is what we want
+// since ns.Controllers is always the full, current set for the network.
+func setControllers(bridgeName string, controllers []string) error {
+	return vsctl(append([]string{"set-controller", bridgeName}, controllers...)...)
+}
+
+// addPhysicalPort attaches an existing host interface to bridgeName,
+// pinning its OpenFlow port number when one was requested.
+func addPhysicalPort(bridgeName string, port AddPort) error {
+	args := []string{"--may-exist", "add-port", bridgeName, port.Name}
+	if port.OFPort != 0 {
+		args = append(args, "--", "set", "Interface", port.Name, fmt.Sprintf("ofport_request=%d", port.OFPort))
+	}
+	return vsctl(args...)
+}
+
+func vsctl(args ...string) error {
+	out, err := exec.Command("ovs-vsctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, string(out))
+	}
+	return nil
+}
+
 func (d *Driver) DeleteNetwork(r *dknet.DeleteNetworkRequest) error {
 	log.Debugf("Delete network request: %+v", r)
-	bridgeName := d.networks[r.NetworkID].BridgeName
-	log.Debugf("Deleting Bridge %s", bridgeName)
-	err := d.deleteBridge(bridgeName)
-	if err != nil {
-		log.Errorf("Deleting bridge %s failed: %s", bridgeName, err)
-		return err
+	ns := d.networks[r.NetworkID]
+
+	if ns.EnableIPMasquerade {
+		if subnet, ok := subnetForMasquerade(ns); ok {
+			if err := removeIPMasquerade(ns.BridgeName, subnet); err != nil {
+				log.Warnf("Unable to remove IP masquerade rule for bridge %s: %s", ns.BridgeName, err)
+			}
+		}
+	}
+
+	if d.bridgeRefs[ns.BridgeName] > 0 {
+		d.bridgeRefs[ns.BridgeName]--
+	}
+
+	if d.bridgeRefs[ns.BridgeName] > 0 {
+		log.Debugf("Bridge [ %s ] still used by %d other network(s), not deleting", ns.BridgeName, d.bridgeRefs[ns.BridgeName])
+	} else {
+		delete(d.bridgeRefs, ns.BridgeName)
+		delete(d.bridgeICC, ns.BridgeName)
+
+		log.Debugf("Deleting Bridge %s", ns.BridgeName)
+		// deleteBridge takes the full network state, not just the bridge name,
+		// so it can also remove the Controller rows applyBridgeOptions attached.
+		if err := d.deleteBridge(ns); err != nil {
+			log.Errorf("Deleting bridge %s failed: %s", ns.BridgeName, err)
+			return err
+		}
 	}
 	delete(d.networks, r.NetworkID)
+
+	if d.datastore != nil {
+		if err := d.datastore.delete(r.NetworkID); err != nil {
+			log.Errorf("Unable to remove persisted state for network %s: %s", r.NetworkID, err)
+		}
+	}
 	return nil
 }
 
 func (d *Driver) CreateEndpoint(r *dknet.CreateEndpointRequest) (*dknet.CreateEndpointResponse, error) {
 	log.Debugf("Create endpoint request: %+v", r)
+	if r.Interface != nil && r.Interface.Address != "" {
+		if ip, _, err := net.ParseCIDR(r.Interface.Address); err == nil {
+			d.endpointIPs[r.EndpointID] = ip
+		}
+	}
 	return nil, nil
 }
 
 func (d *Driver) DeleteEndpoint(r *dknet.DeleteEndpointRequest) error {
 	log.Debugf("Delete endpoint request: %+v", r)
+	delete(d.endpointIPs, r.EndpointID)
 	return nil
 }
 
@@ -221,20 +570,31 @@ func (d *Driver) Join(r *dknet.JoinRequest) (*dknet.JoinResponse, error) {
 		return nil, err
 	}
 	bridgeName := ns.BridgeName
-	err = d.addOvsVethPort(bridgeName, localVethPair.Name, 0)
+	err = d.addOvsVethPort(bridgeName, localVethPair.Name, ns.VlanTag)
 	if err != nil {
 		log.Errorf("error attaching veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
 		return nil, err
 	}
 	log.Infof("Attached veth [ %s ] to bridge [ %s ]", localVethPair.Name, bridgeName)
 
+	if !ns.EnableICC {
+		for _, peerID := range linkedEndpoints(r.Options) {
+			peerPort := ovsPortPrefix + truncateID(peerID)
+			if err := allowICCLink(bridgeName, localVethPair.Name, peerPort); err != nil {
+				log.Errorf("unable to allow linked traffic between [ %s ] and [ %s ] on bridge [ %s ]: %s",
+					localVethPair.Name, peerPort, bridgeName, err)
+			}
+		}
+	}
+
 	// SrcName gets renamed to DstPrefix + ID on the container iface
 	res := &dknet.JoinResponse{
 		InterfaceName: dknet.InterfaceName{
 			SrcName:   localVethPair.PeerName,
 			DstPrefix: containerEthName,
 		},
-		Gateway: ns.Gateway,
+		Gateway:     ns.GatewayIPv4(),
+		GatewayIPv6: ns.GatewayIPv6(),
 	}
 	log.Debugf("Join endpoint %s:%s to %s", r.NetworkID, r.EndpointID, r.SandboxKey)
 	return res, nil
@@ -247,7 +607,13 @@ func (d *Driver) Leave(r *dknet.LeaveRequest) error {
 		log.Errorf("unable to delete veth on leave: %s", err)
 	}
 	portID := fmt.Sprintf(ovsPortPrefix + truncateID(r.EndpointID))
-	bridgeName := d.networks[r.NetworkID].BridgeName
+	ns := d.networks[r.NetworkID]
+	bridgeName := ns.BridgeName
+	if !ns.EnableICC {
+		if err := revokeICCLinks(bridgeName, portID); err != nil {
+			log.Warnf("unable to clear ICC link flows for port [ %s ] on bridge [ %s ]: %s", portID, bridgeName, err)
+		}
+	}
 	err := d.ovsdber.deletePort(bridgeName, portID)
 	if err != nil {
 		log.Errorf("OVS port [ %s ] delete transaction failed on bridge [ %s ] due to: %s", portID, bridgeName, err)
@@ -260,15 +626,44 @@ func (d *Driver) Leave(r *dknet.LeaveRequest) error {
 
 func (d *Driver) ProgramExternalConnectivity(r *dknet.ProgramExternalConnectivityRequest) error {
 	log.Debugf("Program external connectivity request: %+v", r)
+
+	ns, found := d.networks[r.NetworkID]
+	if !found {
+		return fmt.Errorf("no network state [ %s ]", r.NetworkID)
+	}
+	if ns.Mode != modeNAT {
+		log.Debugf("Network [ %s ] is not in NAT mode, skipping port publishing", r.NetworkID)
+		return nil
+	}
+
+	containerIP, found := d.endpointIPs[r.EndpointID]
+	if !found {
+		return fmt.Errorf("no container IP known for endpoint [ %s ]", r.EndpointID)
+	}
+
+	bindings, err := parsePortBindings(r)
+	if err != nil {
+		return fmt.Errorf("unable to parse port bindings: %s", err)
+	}
+
+	for _, binding := range bindings {
+		programmed, err := d.portmapper.program(r.EndpointID, binding, containerIP)
+		if err != nil {
+			log.Errorf("failed to publish port %d/%s for endpoint [ %s ]: %s", binding.Port, binding.Proto, r.EndpointID, err)
+			return err
+		}
+		log.Infof("Published %s port %d on container [ %s ] as host port %d", binding.Proto, binding.Port, r.EndpointID, programmed.HostPort)
+	}
 	return nil
 }
 
 func (d *Driver) RevokeExternalConnectivity(r *dknet.RevokeExternalConnectivityRequest) error {
 	log.Debugf("Revoke external connectivity request: %+v", r)
+	d.portmapper.revokeAll(r.EndpointID)
 	return nil
 }
 
-func NewDriver(name string) (*Driver, error) {
+func NewDriver(name string, stateDBPath string, portRangeStart, portRangeEnd int) (*Driver, error) {
 	docker, err := dockerclient.NewDockerClient("unix:///var/run/docker.sock", nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not connect to docker: %s", err)
@@ -290,6 +685,14 @@ func NewDriver(name string) (*Driver, error) {
 		return nil, fmt.Errorf("could not connect to open vswitch")
 	}
 
+	if stateDBPath == "" {
+		stateDBPath = defaultStateDB
+	}
+	datastore, err := newStateStore(stateDBPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open state database %s: %s", stateDBPath, err)
+	}
+
 	d := &Driver{
 		name: name,
 		dockerer: dockerer{
@@ -298,13 +701,107 @@ func NewDriver(name string) (*Driver, error) {
 		ovsdber: ovsdber{
 			ovsdb: ovsdb,
 		},
-		networks: make(map[string]*NetworkState),
+		networks:    make(map[string]*NetworkState),
+		datastore:   datastore,
+		endpointIPs: make(map[string]net.IP),
+		portmapper:  newPortMapper(portRangeStart, portRangeEnd),
+		bridgeRefs:  make(map[string]int),
+		bridgeICC:   make(map[string]bool),
 	}
 	// Initialize ovsdb cache at rpc connection setup
 	d.ovsdber.initDBCache()
+
+	if err := d.reconcileState(); err != nil {
+		log.Errorf("Error reconciling persisted state with OVSDB: %s", err)
+	}
 	return d, nil
 }
 
+// reconcileState loads every network record persisted in the state
+// database and makes sure OVSDB agrees with it: bridges that are missing
+// are recreated, with their controller/dpid/add_ports options, ICC-deny
+// flow and the gateway addresses of every network on them reapplied, and
+// bridges we find in OVSDB that we have no record of are left alone (they
+// may be managed by something else). IP masquerade rules are not
+// reinstalled here.
+func (d *Driver) reconcileState() error {
+	records, err := d.datastore.all()
+	if err != nil {
+		return err
+	}
+
+	recreated := make(map[string]bool)
+	for id, rec := range records {
+		d.networks[id] = rec.State
+		// Rebuild the bridge refcount by counting persisted networks that
+		// share a bridge name, rather than persisting the count itself, so
+		// it can never drift from what's actually on disk.
+		d.bridgeRefs[rec.State.BridgeName]++
+
+		if d.bridgeRefs[rec.State.BridgeName] > 1 {
+			// The bridge was handled with the first network seen for it;
+			// if it had to be recreated, this network's addresses are gone too.
+			if recreated[rec.State.BridgeName] {
+				if err := d.configureBridgeAddresses(rec.State); err != nil {
+					log.Errorf("Unable to reconfigure addresses on recreated bridge [ %s ] for network [ %s ]: %s", rec.State.BridgeName, id, err)
+				}
+			}
+			continue
+		}
+
+		// This is the first (representative) network we've seen for
+		// the bridge; record the ICC policy actually in effect so a
+		// later CreateNetwork sharing it can warn on a conflict.
+		d.bridgeICC[rec.State.BridgeName] = rec.State.EnableICC
+
+		if d.ovsdber.bridgeExists(rec.State.BridgeName) {
+			continue
+		}
+
+		log.Warnf("Bridge [ %s ] for network [ %s ] is missing, recreating", rec.State.BridgeName, id)
+		if err := d.initBridge(id); err != nil {
+			log.Errorf("Unable to recreate bridge [ %s ] for network [ %s ]: %s", rec.State.BridgeName, id, err)
+			continue
+		}
+		recreated[rec.State.BridgeName] = true
+
+		// initBridge only recreates the bridge itself; reapply the
+		// gateway addresses and ICC-deny flow on top of it.
+		if err := d.configureBridgeAddresses(rec.State); err != nil {
+			log.Errorf("Unable to reconfigure addresses on recreated bridge [ %s ] for network [ %s ]: %s", rec.State.BridgeName, id, err)
+		}
+
+		if err := applyBridgeOptions(rec.State); err != nil {
+			log.Errorf("Unable to reapply controller/dpid/add_ports options on recreated bridge [ %s ] for network [ %s ]: %s", rec.State.BridgeName, id, err)
+		}
+
+		if !rec.State.EnableICC {
+			if err := installICCDenyFlow(rec.State.BridgeName); err != nil {
+				log.Errorf("Unable to reinstall ICC deny flow on recreated bridge [ %s ] for network [ %s ]: %s", rec.State.BridgeName, id, err)
+			}
+		}
+	}
+
+	bridges, err := d.ovsdber.listBridges()
+	if err != nil {
+		log.Errorf("Unable to list OVS bridges during reconciliation: %s", err)
+		return nil
+	}
+	for _, bridge := range bridges {
+		known := false
+		for _, rec := range records {
+			if rec.State.BridgeName == bridge {
+				known = true
+				break
+			}
+		}
+		if !known {
+			log.Warnf("OVS bridge [ %s ] has no persisted network state, leaving it alone", bridge)
+		}
+	}
+	return nil
+}
+
 // Create veth pair. Peername is renamed to eth0 in the container
 func vethPair(suffix string) *netlink.Veth {
 	return &netlink.Veth{
@@ -354,44 +851,79 @@ func getBridgeMode(options map[string]string) (string, error) {
 	return bridgeMode, nil
 }
 
-func getGatewayIP(options map[string]string) (string, string, error) {
-/*
-	// FIXME: Dear future self, I'm sorry for leaving you with this mess, but I want to get this working ASAP
-	// This should be an array
-	// We need to handle case where we have
-	// a. v6 and v4 - dual stack
-	// auxilliary address
-	// multiple subnets on one network
-	// also in that case, we'll need a function to determine the correct default gateway based on it's IP/Mask
-	var gatewayIP string
-
-	if len(r.IPv6Data) > 0 {
-		if r.IPv6Data[0] != nil {
-			if r.IPv6Data[0].Gateway != "" {
-				gatewayIP = r.IPv6Data[0].Gateway
-			}
+// getControllers parses a comma-separated list of OpenFlow controller
+// targets, e.g. "tcp:10.0.0.1:6653,ssl:10.0.0.2:6653".
+func getControllers(options map[string]string) ([]string, error) {
+	raw, ok := options[controllerOption]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+	var controllers []string
+	for _, target := range strings.Split(raw, ",") {
+		target = strings.TrimSpace(target)
+		parts := strings.SplitN(target, ":", 3)
+		if len(parts) != 3 || (parts[0] != "tcp" && parts[0] != "ssl") {
+			return nil, fmt.Errorf("%s is not a valid controller target, expected tcp:host:port or ssl:host:port", target)
 		}
+		controllers = append(controllers, target)
 	}
-	// Assumption: IPAM will provide either IPv4 OR IPv6 but not both
-	// We may want to modify this in future to support dual stack
-	if len(r.IPv4Data) > 0 {
-		if r.IPv4Data[0] != nil {
-			if r.IPv4Data[0].Gateway != "" {
-				gatewayIP = r.IPv4Data[0].Gateway
-			}
-		}
+	return controllers, nil
+}
+
+// getDpid validates the optional datapath ID, which OVSDB expects as a
+// 16 hex digit string set on other_config:datapath-id.
+func getDpid(options map[string]string) (string, error) {
+	dpid, ok := options[dpidOption]
+	if !ok || dpid == "" {
+		return "", nil
 	}
+	if !dpidPattern.MatchString(dpid) {
+		return "", fmt.Errorf("%s is not a valid datapath ID, expected 16 hex digits", dpid)
+	}
+	return dpid, nil
+}
 
-	if gatewayIP == "" {
-		return "", "", fmt.Errorf("No gateway IP found")
+// getVlanTag validates the optional VLAN tag used to let several Docker
+// networks share one underlying OVS bridge, each as its own access port
+// VLAN (useful for VLAN trunking).
+func getVlanTag(options map[string]string) (int, error) {
+	raw, ok := options[vlanOption]
+	if !ok || raw == "" {
+		return 0, nil
+	}
+	tag, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid VLAN tag: %s", raw, err)
+	}
+	if tag < minVlanTag || tag > maxVlanTag {
+		return 0, fmt.Errorf("VLAN tag %d is out of range %d-%d", tag, minVlanTag, maxVlanTag)
 	}
-	parts := strings.Split(gatewayIP, "/")
-	if parts[0] == "" || parts[1] == "" {
-		return "", "", fmt.Errorf("Cannot split gateway IP address")
+	return tag, nil
+}
+
+// getAddPorts parses a comma-separated list of physical interfaces to
+// attach to the bridge at creation time, with an optional ":ofport"
+// suffix to pin the OpenFlow port number, e.g. "eth1,eth2:5".
+func getAddPorts(options map[string]string) ([]AddPort, error) {
+	raw, ok := options[addPortsOption]
+	if !ok || raw == "" {
+		return nil, nil
+	}
+	var ports []AddPort
+	for _, spec := range strings.Split(raw, ",") {
+		spec = strings.TrimSpace(spec)
+		parts := strings.SplitN(spec, ":", 2)
+		port := AddPort{Name: parts[0]}
+		if len(parts) == 2 {
+			ofport, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s has an invalid ofport suffix: %s", spec, err)
+			}
+			port.OFPort = ofport
+		}
+		ports = append(ports, port)
 	}
-	return parts[0], parts[1], nil
-*/
-	return "", "", fmt.Errorf("FIXME")
+	return ports, nil
 }
 
 func getBindInterface(options map[string]string) (string, error) {
@@ -0,0 +1,118 @@
+package ovs
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// linkedEndpoints pulls the peer endpoint IDs a container was started
+// with --link out of JoinRequest.Options.
+func linkedEndpoints(options map[string]interface{}) []string {
+	raw, ok := options[linkOption]
+	if !ok {
+		return nil
+	}
+	str, ok := raw.(string)
+	if !ok || str == "" {
+		return nil
+	}
+	var ids []string
+	for _, id := range strings.Split(str, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// installICCDenyFlow installs the default flow set used when
+// inter-container communication is disabled on a bridge: allow ARP,
+// allow traffic to and from the gateway, and drop everything else by
+// default. Per-link allow rules are then added on top by allowICCLink as
+// containers join with --link.
+//
+// Matching in_port=LOCAL only covers traffic the gateway itself sends;
+// the reverse direction (a container pinging the gateway, DNS, outbound
+// NAT traffic) arrives with in_port=<container> and has to be allowed by
+// destination MAC instead.
+func installICCDenyFlow(bridgeName string) error {
+	if err := ofctl(bridgeName, "add-flow", "priority=200,arp,actions=normal"); err != nil {
+		return err
+	}
+	if err := ofctl(bridgeName, "add-flow", "priority=150,in_port=LOCAL,actions=normal"); err != nil {
+		return err
+	}
+	mac, err := getBridgeMAC(bridgeName)
+	if err != nil {
+		return err
+	}
+	if err := ofctl(bridgeName, "add-flow", fmt.Sprintf("priority=150,dl_dst=%s,actions=normal", mac)); err != nil {
+		return err
+	}
+	return ofctl(bridgeName, "add-flow", "priority=100,actions=drop")
+}
+
+// getBridgeMAC looks up the MAC address OVSDB assigned to a bridge's own
+// LOCAL interface.
+func getBridgeMAC(bridgeName string) (string, error) {
+	out, err := exec.Command("ovs-vsctl", "get", "Interface", bridgeName, "mac_in_use").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, string(out))
+	}
+	return strings.Trim(strings.TrimSpace(string(out)), `"`), nil
+}
+
+// allowICCLink installs a pair of flows permitting traffic between two
+// ports on a bridge where ICC is otherwise disabled.
+func allowICCLink(bridgeName, portA, portB string) error {
+	ofportA, err := getOfPort(bridgeName, portA)
+	if err != nil {
+		return err
+	}
+	ofportB, err := getOfPort(bridgeName, portB)
+	if err != nil {
+		return err
+	}
+	if err := ofctl(bridgeName, "add-flow", fmt.Sprintf("priority=175,in_port=%d,actions=output:%d", ofportA, ofportB)); err != nil {
+		return err
+	}
+	return ofctl(bridgeName, "add-flow", fmt.Sprintf("priority=175,in_port=%d,actions=output:%d", ofportB, ofportA))
+}
+
+// revokeICCLinks removes any per-link allow flows that reference port.
+func revokeICCLinks(bridgeName, port string) error {
+	ofport, err := getOfPort(bridgeName, port)
+	if err != nil {
+		return err
+	}
+	if err := ofctl(bridgeName, "del-flows", fmt.Sprintf("in_port=%d", ofport)); err != nil {
+		return err
+	}
+	return ofctl(bridgeName, "del-flows", fmt.Sprintf("out_port=%d", ofport))
+}
+
+// getOfPort looks up the OpenFlow port number OVSDB assigned to portName
+// on bridgeName, needed because ovs-ofctl flows match on port numbers,
+// not port names.
+func getOfPort(bridgeName, portName string) (int, error) {
+	out, err := exec.Command("ovs-vsctl", "get", "Interface", portName, "ofport").CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", err, string(out))
+	}
+	ofport, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected ofport value for [ %s ] on bridge [ %s ]: %s", portName, bridgeName, string(out))
+	}
+	return ofport, nil
+}
+
+func ofctl(bridgeName, cmd string, flow ...string) error {
+	args := append([]string{cmd, bridgeName}, flow...)
+	out, err := exec.Command("ovs-ofctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, string(out))
+	}
+	return nil
+}
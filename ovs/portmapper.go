@@ -0,0 +1,331 @@
+package ovs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	dknet "github.com/docker/go-plugins-helpers/network"
+)
+
+const (
+	portmapOptionKey = "com.docker.network.portmap"
+
+	dockerChain      = "DOCKER"
+	forwardChain     = "FORWARD"
+	postroutingChain = "POSTROUTING"
+
+	// DefaultHostPortRangeStart and DefaultHostPortRangeEnd bound the
+	// host ports newPortMapper auto-allocates from when the driver isn't
+	// given an explicit --port-range.
+	DefaultHostPortRangeStart = 32768
+	DefaultHostPortRangeEnd   = 60999
+)
+
+// PortBinding is what Docker hands us (JSON-decoded into interface{})
+// under the portmap option on ProgramExternalConnectivity.
+type PortBinding struct {
+	Proto       string
+	IP          net.IP
+	Port        uint16
+	HostIP      net.IP
+	HostPort    uint16
+	HostPortEnd uint16
+}
+
+// parsePortBindings decodes the generic portmap option into a slice of
+// PortBinding.
+func parsePortBindings(r *dknet.ProgramExternalConnectivityRequest) ([]PortBinding, error) {
+	raw, ok := r.Options[portmapOptionKey]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []PortBinding
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return nil, err
+	}
+	return bindings, nil
+}
+
+type activeBinding struct {
+	binding       PortBinding
+	containerIP   net.IP
+	proxy         *userlandProxy
+	autoAllocated bool
+}
+
+// portmapper installs and tracks the iptables DNAT/FORWARD rules needed
+// to publish container ports on NAT-mode networks.
+type portmapper struct {
+	mu          sync.Mutex
+	nextPort    int
+	portRangeLo int
+	portRangeHi int
+	freePorts   []uint16                   // ports released by revoke, reused before nextPort advances
+	bindings    map[string][]activeBinding // keyed by EndpointID
+}
+
+// newPortMapper builds a portmapper that auto-allocates host ports from
+// [rangeStart, rangeEnd]. A zero rangeStart falls back to the package
+// defaults.
+func newPortMapper(rangeStart, rangeEnd int) *portmapper {
+	if rangeStart == 0 {
+		rangeStart, rangeEnd = DefaultHostPortRangeStart, DefaultHostPortRangeEnd
+	}
+	return &portmapper{
+		nextPort:    rangeStart,
+		portRangeLo: rangeStart,
+		portRangeHi: rangeEnd,
+		bindings:    make(map[string][]activeBinding),
+	}
+}
+
+// allocatePort hands out a free host port in the configured range,
+// preferring one a previous revoke() released back to the pool over
+// advancing the high-water mark, so a long-running daemon doing repeated
+// auto-allocated publishes doesn't exhaust the range. It does not probe
+// the host for ports already bound outside of our own bookkeeping.
+func (p *portmapper) allocatePort() (uint16, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.freePorts); n > 0 {
+		port := p.freePorts[n-1]
+		p.freePorts = p.freePorts[:n-1]
+		return port, nil
+	}
+	if p.nextPort > p.portRangeHi {
+		return 0, fmt.Errorf("no free host ports left in range %d-%d", p.portRangeLo, p.portRangeHi)
+	}
+	port := p.nextPort
+	p.nextPort++
+	return uint16(port), nil
+}
+
+// releasePort returns a previously auto-allocated port to the free pool.
+func (p *portmapper) releasePort(port uint16) {
+	p.mu.Lock()
+	p.freePorts = append(p.freePorts, port)
+	p.mu.Unlock()
+}
+
+// program allocates a host port (if one wasn't requested) and installs
+// the DNAT/FORWARD rules that publish binding to containerIP.
+func (p *portmapper) program(endpointID string, binding PortBinding, containerIP net.IP) (PortBinding, error) {
+	autoAllocated := binding.HostPort == 0
+	if autoAllocated {
+		port, err := p.allocatePort()
+		if err != nil {
+			return binding, err
+		}
+		binding.HostPort = port
+	}
+
+	hostIP := binding.HostIP
+
+	if err := iptables("-t", "nat", "-A", dockerChain,
+		append(dnatMatchArgs(binding.Proto, hostIP, binding.HostPort),
+			"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", containerIP.String(), binding.Port))...); err != nil {
+		return binding, fmt.Errorf("failed to add DNAT rule: %s", err)
+	}
+
+	if err := iptables("-A", forwardChain,
+		"-d", containerIP.String(),
+		"-p", binding.Proto,
+		"--dport", fmt.Sprintf("%d", binding.Port),
+		"-j", "ACCEPT"); err != nil {
+		p.revoke(activeBinding{binding: binding, containerIP: containerIP, autoAllocated: autoAllocated})
+		return binding, fmt.Errorf("failed to add FORWARD rule: %s", err)
+	}
+
+	// OVS forwards to the container over the bridge's OpenFlow pipeline,
+	// which never sees traffic a local process sent to its own loopback
+	// address. DNAT can't redirect that either, so the only way to make
+	// "docker run -p 127.0.0.1:8080:80" reach the container is a real
+	// userland relay.
+	var proxy *userlandProxy
+	if hostIP != nil && hostIP.IsLoopback() {
+		var err error
+		proxy, err = startUserlandProxy(binding.Proto, hostIP, binding.HostPort, containerIP, binding.Port)
+		if err != nil {
+			p.revoke(activeBinding{binding: binding, containerIP: containerIP, autoAllocated: autoAllocated})
+			return binding, fmt.Errorf("failed to start userland proxy for %s:%d: %s", hostIP, binding.HostPort, err)
+		}
+	}
+
+	p.mu.Lock()
+	p.bindings[endpointID] = append(p.bindings[endpointID], activeBinding{binding: binding, containerIP: containerIP, proxy: proxy, autoAllocated: autoAllocated})
+	p.mu.Unlock()
+
+	return binding, nil
+}
+
+// dnatMatchArgs builds the protocol/destination/dport match for a DNAT
+// rule; the FORWARD rules match on the container side and build their own.
+// When hostIP is unset we deliberately omit -d rather than matching the
+// literal address 0.0.0.0 ("-d 0.0.0.0" is an exact /32 match on that one
+// address, not a wildcard, so the rule would never match traffic arriving
+// on the host's real interfaces) and match any local address instead.
+func dnatMatchArgs(proto string, hostIP net.IP, hostPort uint16) []string {
+	args := []string{"-p", proto}
+	if hostIP != nil && !hostIP.IsUnspecified() {
+		args = append(args, "-d", hostIP.String())
+	} else {
+		args = append(args, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+	return append(args, "--dport", fmt.Sprintf("%d", hostPort))
+}
+
+// revoke removes the iptables rules and, if one was started, the
+// userland proxy installed by program for a single binding.
+func (p *portmapper) revoke(ab activeBinding) {
+	binding, containerIP := ab.binding, ab.containerIP
+	hostIP := binding.HostIP
+	if ab.proxy != nil {
+		ab.proxy.Close()
+	}
+	if err := iptables("-t", "nat", "-D", dockerChain,
+		append(dnatMatchArgs(binding.Proto, hostIP, binding.HostPort),
+			"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", containerIP.String(), binding.Port))...); err != nil {
+		log.Warnf("failed to remove DNAT rule for %s:%d: %s", hostIP, binding.HostPort, err)
+	}
+	if err := iptables("-D", forwardChain,
+		"-d", containerIP.String(),
+		"-p", binding.Proto,
+		"--dport", fmt.Sprintf("%d", binding.Port),
+		"-j", "ACCEPT"); err != nil {
+		log.Warnf("failed to remove FORWARD rule for %s:%d: %s", containerIP, binding.Port, err)
+	}
+	if ab.autoAllocated {
+		p.releasePort(binding.HostPort)
+	}
+}
+
+// revokeAll tears down every binding previously programmed for an endpoint.
+func (p *portmapper) revokeAll(endpointID string) {
+	p.mu.Lock()
+	bindings := p.bindings[endpointID]
+	delete(p.bindings, endpointID)
+	p.mu.Unlock()
+
+	for _, b := range bindings {
+		p.revoke(b)
+	}
+}
+
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, string(out))
+	}
+	return nil
+}
+
+// subnetForMasquerade picks the network's IPv4 gateway entry and returns
+// it as a "<network>/<mask>" CIDR suitable for an iptables -s match,
+// rather than the single gateway host address stored on the entry.
+func subnetForMasquerade(ns *NetworkState) (string, bool) {
+	for _, entry := range ns.IPAM {
+		if entry.Family != familyV4 {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(fmt.Sprintf("%s/%s", entry.IP, entry.Mask))
+		if err != nil {
+			continue
+		}
+		return ipNet.String(), true
+	}
+	return "", false
+}
+
+// installIPMasquerade adds the POSTROUTING MASQUERADE rule that lets
+// containers on subnet reach the outside world through the host's
+// interface(s). Traffic leaving back out the bridge itself
+// (container-to-container through the host) is excluded.
+func installIPMasquerade(bridgeName, subnet string) error {
+	return iptables("-t", "nat", "-A", postroutingChain,
+		"-s", subnet,
+		"!", "-o", bridgeName,
+		"-j", "MASQUERADE")
+}
+
+// removeIPMasquerade undoes installIPMasquerade.
+func removeIPMasquerade(bridgeName, subnet string) error {
+	return iptables("-t", "nat", "-D", postroutingChain,
+		"-s", subnet,
+		"!", "-o", bridgeName,
+		"-j", "MASQUERADE")
+}
+
+// userlandProxy relays a single published port between the host and a
+// container, for the one case OVS's OpenFlow-based forwarding and DNAT
+// can't cover: a host binding on a loopback address, which only a real
+// process listening on that address can ever receive.
+type userlandProxy struct {
+	listener net.Listener
+}
+
+// startUserlandProxy starts relaying hostIP:hostPort to
+// containerIP:containerPort. Only TCP is supported; UDP loopback
+// publishes are rare enough, and OVS's default forwarding already covers
+// every other combination, that they're left to fail the way they always
+// have rather than adding a second relay implementation here.
+func startUserlandProxy(proto string, hostIP net.IP, hostPort uint16, containerIP net.IP, containerPort uint16) (*userlandProxy, error) {
+	if proto != "tcp" {
+		return nil, fmt.Errorf("userland proxy fallback only supports tcp, not %s", proto)
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", hostIP, hostPort))
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &userlandProxy{listener: listener}
+	go proxy.serve(fmt.Sprintf("%s:%d", containerIP, containerPort))
+	return proxy, nil
+}
+
+func (proxy *userlandProxy) serve(containerAddr string) {
+	for {
+		client, err := proxy.listener.Accept()
+		if err != nil {
+			return
+		}
+		go proxy.relay(client, containerAddr)
+	}
+}
+
+func (proxy *userlandProxy) relay(client net.Conn, containerAddr string) {
+	defer client.Close()
+
+	upstream, err := net.Dial("tcp", containerAddr)
+	if err != nil {
+		log.Warnf("userland proxy: could not reach %s: %s", containerAddr, err)
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// Close stops accepting new connections. Connections already relaying
+// are left to finish on their own.
+func (proxy *userlandProxy) Close() {
+	proxy.listener.Close()
+}
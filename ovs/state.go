@@ -0,0 +1,94 @@
+package ovs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	defaultStateDB = "/var/lib/docker-ovs-plugin/state.db"
+
+	networksBucket = "networks"
+)
+
+// networkRecord is the unit persisted to the state database for every
+// network we manage. It carries enough information to fully recreate the
+// in-memory NetworkState without having to consult libnetwork again, since
+// CreateNetwork is only ever delivered to us once.
+type networkRecord struct {
+	State   *NetworkState
+	Options map[string]string
+}
+
+// stateStore wraps a boltdb file used to persist network state across
+// plugin restarts.
+type stateStore struct {
+	db *bolt.DB
+}
+
+func newStateStore(path string) (*stateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(networksBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) close() error {
+	return s.db.Close()
+}
+
+// put persists the record for the given network ID, overwriting any
+// previous entry.
+func (s *stateStore) put(id string, rec *networkRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(networksBucket)).Put([]byte(id), data)
+	})
+}
+
+// delete removes the persisted record for the given network ID, if any.
+func (s *stateStore) delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(networksBucket)).Delete([]byte(id))
+	})
+}
+
+// all loads every persisted network record, keyed by network ID.
+func (s *stateStore) all() (map[string]*networkRecord, error) {
+	records := make(map[string]*networkRecord)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(networksBucket))
+		return b.ForEach(func(k, v []byte) error {
+			rec := &networkRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				log.Errorf("Skipping corrupt state record for network %s: %s", string(k), err)
+				return nil
+			}
+			records[string(k)] = rec
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}